@@ -0,0 +1,272 @@
+package log
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"time"
+)
+
+// ErrWriteAheadLogClosed is returned by Write (and so Put/Delete) once Close
+// has been called, instead of blocking forever on a commit loop that is no
+// longer running.
+var ErrWriteAheadLogClosed = errors.New("log: write-ahead log is closed")
+
+// DefaultMaxBatchBytes is the default WALOptions.MaxBatchBytes: how many
+// bytes of pending writes the commit loop will coalesce before flushing
+// early, even if MaxBatchDelay hasn't elapsed yet.
+const DefaultMaxBatchBytes = 1 << 20 // 1 MiB
+
+// DefaultMaxBatchDelay is the default WALOptions.MaxBatchDelay: how long
+// the commit loop waits for more writers to join a batch before flushing
+// whatever it has.
+const DefaultMaxBatchDelay = time.Millisecond
+
+// WALOptions configures WriteAheadLog's group-commit pipeline.
+type WALOptions struct {
+	// SyncWrites makes every batch call file.Sync() after it's appended,
+	// regardless of whether any individual Write call asked for it.
+	SyncWrites bool
+	// MaxBatchBytes bounds how many bytes of pending writes are coalesced
+	// into one Append before flushing early. Zero means DefaultMaxBatchBytes.
+	MaxBatchBytes int
+	// MaxBatchDelay bounds how long the commit loop waits for more writers
+	// to join a batch. Zero means DefaultMaxBatchDelay.
+	MaxBatchDelay time.Duration
+
+	// OnCorrupt controls how readAllLogEntries reacts to a quarantined or
+	// freshly-corrupt record during replay. Zero means OnCorruptAbort.
+	OnCorrupt OnCorruptPolicy
+	// ScrubRate is the rate, in bytes/sec, the periodic scrubber (see
+	// ScrubInterval) runs Scrub at. Zero means unthrottled.
+	ScrubRate int
+	// ScrubInterval, if positive and the underlying log implements Scrubber
+	// (FileLog does; SegmentedLog does not), runs a full Scrub of that log on
+	// this interval for as long as the WriteAheadLog is open, so long-lived
+	// logs detect silent disk corruption before something tries to replay
+	// it. Zero disables the periodic scrubber; Scrub can still be called
+	// directly on a *FileLog.
+	ScrubInterval time.Duration
+}
+
+func (opts WALOptions) withDefaults() WALOptions {
+	if opts.MaxBatchBytes <= 0 {
+		opts.MaxBatchBytes = DefaultMaxBatchBytes
+	}
+	if opts.MaxBatchDelay <= 0 {
+		opts.MaxBatchDelay = DefaultMaxBatchDelay
+	}
+	return opts
+}
+
+// Syncer is implemented by logs that can force buffered writes to disk.
+// WriteAheadLog's group-commit loop uses it to issue at most one fsync per
+// coalesced batch.
+type Syncer interface {
+	Sync() error
+}
+
+// Batch is a set of Put/Delete operations that WriteAheadLog.Write commits
+// together as a single Log.Append, so concurrent writers share one fsync
+// instead of paying for one each (LevelDB-style group commit).
+type Batch struct {
+	ops []WriteOperation
+}
+
+// Put stages a PUT of key/value in the batch.
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, WriteOperation{WriteOperationType: PUT, Key: key, Value: value})
+}
+
+// Delete stages a DELETE of key in the batch.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, WriteOperation{WriteOperationType: DELETE, Key: key})
+}
+
+// writeRequest is one caller's Batch waiting to be picked up by the commit
+// loop, along with where to deliver its result.
+type writeRequest struct {
+	batch *Batch
+	sync  bool
+	done  chan error
+}
+
+// batchByteSize estimates how many log bytes a batch's operations will
+// take up, for MaxBatchBytes accounting.
+func batchByteSize(b *Batch) int {
+	size := 0
+	for _, op := range b.ops {
+		size += len(op.Key) + len(op.Value)
+	}
+	return size
+}
+
+// Write commits b as a single unit: every Put/Delete in it goes into the same
+// log record, so replay applies all of them or none, and (once committed)
+// they are durable according to sync and the WriteAheadLog's WALOptions.
+// The in-memory index is updated one operation at a time after the append,
+// so a concurrent Get can see some of b's operations before the rest.
+// Write enqueues b with the group-commit
+// loop and blocks until it - and whatever other batches were coalesced
+// alongside it - have been appended (and, if requested, fsynced).
+//
+// If Close has already been called (or races with this call), Write returns
+// ErrWriteAheadLogClosed instead of blocking forever: once the commit loop
+// stops, nothing is left to receive on writeCh or to ever signal req.done.
+func (wal *WriteAheadLog) Write(b *Batch, sync bool) error {
+	req := &writeRequest{batch: b, sync: sync, done: make(chan error, 1)}
+	select {
+	case wal.writeCh <- req:
+	case <-wal.stopCh:
+		return ErrWriteAheadLogClosed
+	}
+	return <-req.done
+}
+
+// runCommitLoop is the single goroutine that owns all appends to wal.log:
+// it waits for the first pending writer, then keeps coalescing further
+// writers into the same batch until MaxBatchBytes or MaxBatchDelay is hit,
+// commits them all with a single Append and at most one Sync, and wakes
+// every waiter with its result.
+func (wal *WriteAheadLog) runCommitLoop() {
+	defer close(wal.commitLoopDone)
+
+	for {
+		var first *writeRequest
+		select {
+		case <-wal.stopCh:
+			return
+		case first = <-wal.writeCh:
+		}
+
+		reqs := []*writeRequest{first}
+		pendingBytes := batchByteSize(first.batch)
+
+		timer := time.NewTimer(wal.options.MaxBatchDelay)
+	collecting:
+		for {
+			select {
+			case req := <-wal.writeCh:
+				reqs = append(reqs, req)
+				pendingBytes += batchByteSize(req.batch)
+				if pendingBytes >= wal.options.MaxBatchBytes {
+					break collecting
+				}
+			case <-timer.C:
+				break collecting
+			case <-wal.stopCh:
+				break collecting
+			}
+		}
+		timer.Stop()
+
+		wal.commitBatch(reqs)
+	}
+}
+
+// commitBatch applies value-log separation, serializes every operation in
+// reqs into one buffer, and appends that buffer to wal.log as a single
+// record. Only once that Append (and, if needed, Sync) has succeeded does
+// it update the in-memory index and wake the waiting callers.
+func (wal *WriteAheadLog) commitBatch(reqs []*writeRequest) {
+	buf := new(bytes.Buffer)
+	encoder := gob.NewEncoder(buf)
+	anySync := wal.options.SyncWrites
+	wroteValuePointer := false
+
+	for _, req := range reqs {
+		if req.sync {
+			anySync = true
+		}
+		for i := range req.batch.ops {
+			op := &req.batch.ops[i]
+			if op.WriteOperationType == PUT && wal.valueLog != nil && len(op.Value) > wal.valueThreshold {
+				ptr, err := wal.valueLog.Append(op.Value)
+				if err != nil {
+					failBatch(reqs, err)
+					return
+				}
+				op.Value = encodeValuePointer(ptr)
+				op.Flags |= flagValuePointer
+				wroteValuePointer = true
+			}
+			if err := encoder.Encode(*op); err != nil {
+				failBatch(reqs, err)
+				return
+			}
+		}
+	}
+
+	if _, err := wal.log.Append(buf.Bytes()); err != nil {
+		failBatch(reqs, err)
+		return
+	}
+
+	if anySync {
+		// Sync the value log before the main log: a ValuePointer must never
+		// be made durable before the value it points to, or a crash in
+		// between leaves a dangling pointer that Get can never resolve.
+		if wroteValuePointer {
+			if err := wal.valueLog.Sync(); err != nil {
+				failBatch(reqs, err)
+				return
+			}
+		}
+		if syncer, ok := wal.log.(Syncer); ok {
+			if err := syncer.Sync(); err != nil {
+				failBatch(reqs, err)
+				return
+			}
+		}
+	}
+
+	writes := 0
+	for _, req := range reqs {
+		for _, op := range req.batch.ops {
+			switch op.WriteOperationType {
+			case PUT:
+				wal.index.Put(op.Key, encodeIndexValue(op.Flags, op.Value))
+			case DELETE:
+				wal.index.Delete(op.Key)
+			}
+			writes++
+		}
+	}
+
+	// Run any automatic compaction before acknowledging the batch, so that
+	// (as before group commit) a Write call that crosses a CompactEvery
+	// threshold doesn't return until the resulting snapshot is on disk.
+	// A failed automatic compaction doesn't invalidate the writes themselves;
+	// callers that need to know whether it succeeded should call Compact
+	// directly.
+	wal.writesSinceCompaction += writes
+	if wal.policy.CompactEvery > 0 && wal.writesSinceCompaction >= wal.policy.CompactEvery {
+		_ = wal.Compact()
+	}
+
+	for _, req := range reqs {
+		req.done <- nil
+	}
+}
+
+func failBatch(reqs []*writeRequest, err error) {
+	for _, req := range reqs {
+		req.done <- err
+	}
+}
+
+// Close stops the group-commit loop and closes the underlying Log (and, if
+// configured, the value log). It waits for runCommitLoop to actually return
+// - draining whatever batch it already had in flight - before closing
+// either out from under it.
+func (wal *WriteAheadLog) Close() error {
+	close(wal.stopCh)
+	<-wal.commitLoopDone
+
+	if wal.valueLog != nil {
+		if err := wal.valueLog.Close(); err != nil {
+			return err
+		}
+	}
+	return wal.log.Close()
+}
@@ -1,10 +1,24 @@
 package log
 
+// Log is the durable append-only record store that WriteAheadLog is built
+// on top of. FileLog and SegmentedLog both implement it.
 type Log interface {
-	// Append a record to the log.
-	Append(record []byte) (offset uint64, error error)
-	// Read a record from the log.
-	Read(offset uint64) (record []byte, error error)
+	// Append a record to the log, returning the offset it was written at.
+	Append(record []byte) (offset uint64, err error)
+	// Read the record at offset, returning the offset the next record
+	// starts at.
+	Read(offset uint64) (record []byte, nextOffset uint64, err error)
+	// Size returns the offset at which the next Append will write, i.e.
+	// the current logical end of the log.
+	Size() (offset uint64, err error)
 	// Close the log.
 	Close() error
 }
+
+// Retainer is implemented by logs that can drop everything but their most
+// recent n segments, such as SegmentedLog. WriteAheadLog uses it after
+// taking a snapshot to reclaim the disk space of segments it no longer
+// needs to replay.
+type Retainer interface {
+	RetainLast(n int) error
+}
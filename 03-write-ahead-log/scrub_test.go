@@ -0,0 +1,153 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// corruptChunkPayload flips a byte inside the first chunk's payload at
+// offset (which must be a FULL-chunk record boundary), so its CRC no longer
+// matches without otherwise disturbing the framing.
+func corruptChunkPayload(t *testing.T, path string, offset uint64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("cannot open log file: %v", err)
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, int64(offset)+chunkHeaderSize); err != nil {
+		t.Fatalf("cannot read byte to corrupt: %v", err)
+	}
+	b[0] ^= 0xFF
+	if _, err := f.WriteAt(b, int64(offset)+chunkHeaderSize); err != nil {
+		t.Fatalf("cannot corrupt byte: %v", err)
+	}
+}
+
+func TestScrubDetectsCorruptionAndQuarantinesOffset(t *testing.T) {
+	t.Parallel()
+	dir, err := os.MkdirTemp("", "scrub")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/log"
+
+	fl, err := NewFileLog(path)
+	if err != nil {
+		t.Fatalf("cannot create file log: %v", err)
+	}
+
+	goodOffset, err := fl.Append([]byte("good record"))
+	if err != nil {
+		t.Fatalf("cannot append good record: %v", err)
+	}
+	badOffset, err := fl.Append([]byte("bad record"))
+	if err != nil {
+		t.Fatalf("cannot append bad record: %v", err)
+	}
+	if err := fl.Close(); err != nil {
+		t.Fatalf("cannot close file log: %v", err)
+	}
+
+	corruptChunkPayload(t, path, badOffset)
+
+	fl, err = NewFileLog(path)
+	if err != nil {
+		t.Fatalf("cannot reopen file log: %v", err)
+	}
+	defer fl.Close()
+
+	reports, err := fl.Scrub(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("cannot start scrub: %v", err)
+	}
+
+	var results []ScrubReport
+	for report := range reports {
+		results = append(results, report)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d reports, want 2", len(results))
+	}
+	if !results[0].OK || results[0].Offset != goodOffset {
+		t.Errorf("good record reported %+v", results[0])
+	}
+	if results[1].OK || results[1].Offset != badOffset {
+		t.Errorf("bad record reported %+v", results[1])
+	}
+
+	_, _, err = fl.Read(badOffset)
+	var corrupt *ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("expected ErrCorrupt reading quarantined offset, got %v", err)
+	}
+	assert.Equal(t, badOffset, corrupt.Offset)
+
+	got, _, err := fl.Read(goodOffset)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("good record"), got)
+}
+
+func TestReplaySkipsCorruptRecordsWithOnCorruptSkip(t *testing.T) {
+	t.Parallel()
+	dir, err := os.MkdirTemp("", "scrub")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/log"
+
+	fl, err := NewFileLog(path)
+	if err != nil {
+		t.Fatalf("cannot create file log: %v", err)
+	}
+	wal, err := newWriteAheadLog(fl, ValueLogOptions{}, CompactionPolicy{}, WALOptions{})
+	if err != nil {
+		t.Fatalf("cannot create write-ahead log: %v", err)
+	}
+
+	assert.NoError(t, wal.Put([]byte("Key1"), []byte("Value1")))
+	badOffset, err := fl.Size()
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Put([]byte("Key2"), []byte("Value2")))
+	assert.NoError(t, wal.Put([]byte("Key3"), []byte("Value3")))
+	assert.NoError(t, wal.Close())
+
+	corruptChunkPayload(t, path, badOffset)
+
+	reopenedLog, err := NewFileLog(path)
+	if err != nil {
+		t.Fatalf("cannot reopen file log: %v", err)
+	}
+	reopened, err := newWriteAheadLog(reopenedLog, ValueLogOptions{}, CompactionPolicy{}, WALOptions{OnCorrupt: OnCorruptSkip})
+	if err != nil {
+		t.Fatalf("cannot replay with OnCorruptSkip: %v", err)
+	}
+	defer reopened.Close()
+
+	got, err := reopened.Get([]byte("Key1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("Value1"), got)
+
+	got, err = reopened.Get([]byte("Key2"))
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	// Key3 shares Key2's block, and a CRC failure now resyncs to the next
+	// block boundary rather than trusting the corrupted chunk's length (see
+	// readChunksLocked): a torn write can corrupt length right along with
+	// the payload, so trusting it risks misframing everything after it.
+	// That means Key3 is lost along with Key2 here, not recovered - OnCorruptSkip
+	// only guarantees replay keeps going past the bad block, not that every
+	// record sharing it survives.
+	got, err = reopened.Get([]byte("Key3"))
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
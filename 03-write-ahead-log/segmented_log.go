@@ -0,0 +1,603 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// segmentMagic identifies a valid segment file, written as the first 4 bytes
+// of every segment so that a half-written or foreign file is never mistaken
+// for a real one during replay.
+const segmentMagic uint32 = 0x43AF00EF
+
+// segmentFormatVersion is the 1-byte format version that follows the magic.
+// Bump this if the on-disk chunk layout of a segment ever changes.
+const segmentFormatVersion byte = 1
+
+// segmentHeaderSize is the number of bytes occupied by the magic and version
+// at the start of every segment file. Record offsets within a segment are
+// always relative to the byte right after this header.
+const segmentHeaderSize = 4 + 1
+
+// DefaultSegmentSize is the size, in bytes, at which SegmentedLog rotates to
+// a new segment file if the caller does not provide one of their own.
+const DefaultSegmentSize int64 = 64 * 1024 * 1024 // 64 MiB
+
+// maxOpenSegmentHandles bounds how many segment files SegmentedLog keeps
+// open at once for reads. Older handles are evicted LRU-style.
+const maxOpenSegmentHandles = 8
+
+// segment tracks the on-disk metadata for a single segment file.
+type segment struct {
+	number      uint32
+	path        string
+	baseOffset  uint64 // first global offset stored in this segment (unused by Read, kept for diagnostics)
+	size        int64  // number of bytes written after the header
+}
+
+// openHandle is an entry in the SegmentedLog's LRU of open file descriptors.
+type openHandle struct {
+	number uint32
+	file   *os.File
+}
+
+// SegmentedLog is a Log that is stored as a directory of fixed-size segment
+// files rather than a single ever-growing file, in the style of the
+// Prometheus TSDB and etcd WAL. Segments are named "%08d.log" with the
+// segment number, and each begins with a small magic/version header.
+type SegmentedLog struct {
+	dir         string
+	segmentSize int64
+
+	segments []*segment // ordered by segment number, oldest first
+
+	active     *os.File
+	activeSeg  *segment
+
+	handles []*openHandle // small LRU of open read handles, most-recently-used last
+}
+
+// NewSegmentedLog opens (or creates) a directory of log segments. Existing
+// segments are enumerated in order, their magic/version headers validated,
+// and the last segment is replayed to detect a torn write: if a short read
+// or bad checksum is found, the segment is truncated at the last good
+// record instead of failing to open.
+func NewSegmentedLog(dir string) (*SegmentedLog, error) {
+	return NewSegmentedLogSize(dir, DefaultSegmentSize)
+}
+
+// NewSegmentedLogSize is like NewSegmentedLog but allows overriding the
+// rotation threshold, mainly so tests don't need to write 64 MiB to exercise
+// rotation.
+func NewSegmentedLogSize(dir string, segmentSize int64) (*SegmentedLog, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	sl := &SegmentedLog{dir: dir, segmentSize: segmentSize}
+
+	segments, err := loadSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	sl.segments = segments
+
+	if len(sl.segments) == 0 {
+		if err := sl.rotate(); err != nil {
+			return nil, err
+		}
+		return sl, nil
+	}
+
+	last := sl.segments[len(sl.segments)-1]
+	size, err := recoverSegment(last.path)
+	if err != nil {
+		return nil, err
+	}
+	last.size = size
+
+	active, err := os.OpenFile(last.path, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	sl.active = active
+	sl.activeSeg = last
+
+	return sl, nil
+}
+
+// segmentFileName returns the canonical file name for a segment number.
+func segmentFileName(number uint32) string {
+	return fmt.Sprintf("%08d.log", number)
+}
+
+// loadSegments scans dir for segment files, validates each header, and
+// returns them sorted by segment number. Every segment but the last is
+// necessarily sealed (already rotated away from and fsynced), so its size
+// is read straight from the file; the last segment's size is left for the
+// caller to fill in via recoverSegment, which also handles a torn write.
+func loadSegments(dir string) ([]*segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*segment
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+
+		numberPart := strings.TrimSuffix(entry.Name(), ".log")
+		number, err := strconv.ParseUint(numberPart, 10, 32)
+		if err != nil {
+			// Not one of our segment files; skip it.
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if err := validateSegmentHeader(path); err != nil {
+			return nil, fmt.Errorf("segment %s: %w", entry.Name(), err)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		segments = append(segments, &segment{
+			number:     uint32(number),
+			path:       path,
+			baseOffset: encodeOffset(uint32(number), 0),
+			size:       info.Size() - segmentHeaderSize,
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].number < segments[j].number })
+	return segments, nil
+}
+
+// validateSegmentHeader opens path and confirms its magic and format version.
+func validateSegmentHeader(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, segmentHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return fmt.Errorf("cannot read segment header: %w", err)
+	}
+
+	magic := binary.BigEndian.Uint32(header[:4])
+	if magic != segmentMagic {
+		return fmt.Errorf("bad segment magic %x", magic)
+	}
+	if header[4] != segmentFormatVersion {
+		return fmt.Errorf("unsupported segment format version %d", header[4])
+	}
+
+	return nil
+}
+
+// recoverSegment replays every record in the segment at path and returns the
+// byte offset (relative to the end of the header) of the last good record.
+// If a torn write is found - a short read or a bad checksum - the segment is
+// truncated at that point so future appends start from a clean state.
+func recoverSegment(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(segmentHeaderSize, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var good int64
+	for {
+		lenBuf := make([]byte, 8)
+		if _, err := io.ReadFull(f, lenBuf); err != nil {
+			break
+		}
+		recordLen := binary.BigEndian.Uint64(lenBuf)
+
+		payload := make([]byte, recordLen)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			break
+		}
+
+		crcBuf := make([]byte, 4)
+		if _, err := io.ReadFull(f, crcBuf); err != nil {
+			break
+		}
+		crc := binary.BigEndian.Uint32(crcBuf)
+		if crc32.ChecksumIEEE(payload) != crc {
+			break
+		}
+
+		good += 8 + int64(recordLen) + 4
+	}
+
+	if err := f.Truncate(segmentHeaderSize + good); err != nil {
+		return 0, err
+	}
+
+	return good, nil
+}
+
+// Rotate seals the active segment and starts a fresh one, even if the
+// active segment hasn't reached SegmentSize yet. Callers use this to get a
+// segment number off the active path, for example before garbage
+// collecting it.
+func (sl *SegmentedLog) Rotate() error {
+	return sl.rotate()
+}
+
+// rotate fsyncs and closes the current active segment (if any) and starts a
+// new one, writing its magic/version header.
+func (sl *SegmentedLog) rotate() error {
+	if sl.active != nil {
+		if err := sl.active.Sync(); err != nil {
+			return err
+		}
+		if err := sl.active.Close(); err != nil {
+			return err
+		}
+	}
+
+	var number uint32
+	if len(sl.segments) > 0 {
+		number = sl.segments[len(sl.segments)-1].number + 1
+	}
+
+	path := filepath.Join(sl.dir, segmentFileName(number))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, segmentHeaderSize)
+	binary.BigEndian.PutUint32(header[:4], segmentMagic)
+	header[4] = segmentFormatVersion
+	if _, err := f.Write(header); err != nil {
+		return err
+	}
+
+	seg := &segment{number: number, path: path, baseOffset: encodeOffset(number, 0)}
+	sl.segments = append(sl.segments, seg)
+	sl.active = f
+	sl.activeSeg = seg
+	return nil
+}
+
+// encodeOffset packs a segment number into the high 32 bits of a global
+// offset and a byte offset within that segment into the low 32 bits.
+func encodeOffset(segmentNumber uint32, localOffset int64) uint64 {
+	return uint64(segmentNumber)<<32 | uint64(uint32(localOffset))
+}
+
+// decodeOffset is the inverse of encodeOffset.
+func decodeOffset(offset uint64) (segmentNumber uint32, localOffset int64) {
+	return uint32(offset >> 32), int64(uint32(offset))
+}
+
+// Append writes record to the active segment, rotating to a fresh segment
+// first if it would no longer fit under SegmentSize.
+func (sl *SegmentedLog) Append(record []byte) (offset uint64, err error) {
+	recordSize := int64(8 + len(record) + 4)
+	if sl.activeSeg.size > 0 && sl.activeSeg.size+recordSize > sl.segmentSize {
+		if err := sl.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	localOffset := sl.activeSeg.size
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, uint64(len(record))); err != nil {
+		return 0, err
+	}
+	if _, err := buf.Write(record); err != nil {
+		return 0, err
+	}
+	checksum := crc32.ChecksumIEEE(record)
+	if err := binary.Write(buf, binary.BigEndian, checksum); err != nil {
+		return 0, err
+	}
+
+	// Read shares the active file handle and moves its position, and a
+	// reopened segment starts at position 0, so write at the logical end
+	// explicitly rather than wherever the handle was left.
+	if _, err := sl.active.Seek(segmentHeaderSize+localOffset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := sl.active.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	sl.activeSeg.size += recordSize
+
+	return encodeOffset(sl.activeSeg.number, localOffset), nil
+}
+
+// handleFor returns an open *os.File for segmentNumber, reusing the LRU of
+// already-open handles or opening the file on demand and evicting the
+// least-recently-used handle if the LRU is full.
+func (sl *SegmentedLog) handleFor(segmentNumber uint32) (*os.File, error) {
+	if sl.activeSeg != nil && sl.activeSeg.number == segmentNumber {
+		return sl.active, nil
+	}
+
+	for i, h := range sl.handles {
+		if h.number == segmentNumber {
+			// Move to the back (most-recently-used).
+			sl.handles = append(append(sl.handles[:i], sl.handles[i+1:]...), h)
+			return h.file, nil
+		}
+	}
+
+	seg := sl.segmentByNumber(segmentNumber)
+	if seg == nil {
+		return nil, fmt.Errorf("segment %d not found", segmentNumber)
+	}
+
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sl.handles) >= maxOpenSegmentHandles {
+		evicted := sl.handles[0]
+		sl.handles = sl.handles[1:]
+		evicted.file.Close()
+	}
+	sl.handles = append(sl.handles, &openHandle{number: segmentNumber, file: f})
+
+	return f, nil
+}
+
+func (sl *SegmentedLog) segmentByNumber(number uint32) *segment {
+	for _, s := range sl.segments {
+		if s.number == number {
+			return s
+		}
+	}
+	return nil
+}
+
+// Read decodes the segment number from the high bits of offset, opens that
+// segment on demand (via a small LRU of handles), and reads the record at
+// the encoded local offset. If localOffset lands exactly at the end of a
+// sealed segment (the nextOffset a previous Read of its last record
+// returned), Read rolls over to local offset 0 of the following segment
+// instead of reading past that segment's end - otherwise every record after
+// the first segment would be mistaken for end-of-log on replay.
+func (sl *SegmentedLog) Read(offset uint64) (record []byte, nextOffset uint64, err error) {
+	segmentNumber, localOffset := decodeOffset(offset)
+
+	if seg := sl.segmentByNumber(segmentNumber); seg != nil && localOffset >= seg.size {
+		if next := sl.segmentByNumber(segmentNumber + 1); next != nil {
+			segmentNumber, localOffset = next.number, 0
+		}
+	}
+
+	f, err := sl.handleFor(segmentNumber)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := f.Seek(segmentHeaderSize+localOffset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	var recordLen uint64
+	if err := binary.Read(f, binary.BigEndian, &recordLen); err != nil {
+		return nil, 0, err
+	}
+
+	record = make([]byte, recordLen)
+	if _, err := io.ReadFull(f, record); err != nil {
+		return nil, 0, err
+	}
+
+	var checksum uint32
+	if err := binary.Read(f, binary.BigEndian, &checksum); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(record) != checksum {
+		return nil, 0, errors.New("data corruption detected")
+	}
+
+	nextLocal := localOffset + 8 + int64(recordLen) + 4
+	return record, encodeOffset(segmentNumber, nextLocal), nil
+}
+
+// Truncate discards every record at or after the global offset upTo: later
+// segments are removed outright and the segment containing upTo is
+// truncated to the local offset it encodes.
+func (sl *SegmentedLog) Truncate(upTo uint64) error {
+	segmentNumber, localOffset := decodeOffset(upTo)
+
+	var kept []*segment
+	for _, seg := range sl.segments {
+		if seg.number < segmentNumber {
+			kept = append(kept, seg)
+			continue
+		}
+		if seg.number == segmentNumber {
+			if sl.activeSeg == seg {
+				if err := sl.active.Truncate(segmentHeaderSize + localOffset); err != nil {
+					return err
+				}
+			} else if err := os.Truncate(seg.path, segmentHeaderSize+localOffset); err != nil {
+				return err
+			}
+			seg.size = localOffset
+			kept = append(kept, seg)
+			continue
+		}
+		// seg.number > segmentNumber: remove entirely.
+		sl.closeHandle(seg.number)
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+	}
+
+	sl.segments = kept
+	if sl.activeSeg.number != segmentNumber {
+		// The active segment was removed; fall back to the new tail.
+		last := sl.segments[len(sl.segments)-1]
+		active, err := os.OpenFile(last.path, os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+		sl.active.Close()
+		sl.active = active
+		sl.activeSeg = last
+	}
+
+	return nil
+}
+
+// RetainLast deletes every segment except the last n, so a snapshot taken
+// after those segments is no longer needed can reclaim their disk space.
+// The active segment is always kept regardless of n.
+func (sl *SegmentedLog) RetainLast(n int) error {
+	if n < 1 {
+		n = 1
+	}
+	if len(sl.segments) <= n {
+		return nil
+	}
+
+	toRemove := sl.segments[:len(sl.segments)-n]
+	for _, seg := range toRemove {
+		sl.closeHandle(seg.number)
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+	}
+	sl.segments = sl.segments[len(sl.segments)-n:]
+
+	return nil
+}
+
+func (sl *SegmentedLog) closeHandle(number uint32) {
+	for i, h := range sl.handles {
+		if h.number == number {
+			h.file.Close()
+			sl.handles = append(sl.handles[:i], sl.handles[i+1:]...)
+			return
+		}
+	}
+}
+
+// ReadSegment walks every record in segmentNumber from start to end,
+// calling fn with each record's local offset (the offset encodeOffset
+// expects for that segment) and payload. It stops early if fn returns
+// false.
+func (sl *SegmentedLog) ReadSegment(segmentNumber uint32, fn func(localOffset int64, record []byte) bool) error {
+	f, err := sl.handleFor(segmentNumber)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(segmentHeaderSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	var pos int64
+	for {
+		lenBuf := make([]byte, 8)
+		if _, err := io.ReadFull(f, lenBuf); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		length := binary.BigEndian.Uint64(lenBuf)
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			return err
+		}
+
+		crcBuf := make([]byte, 4)
+		if _, err := io.ReadFull(f, crcBuf); err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(crcBuf) {
+			return errors.New("segment corrupt during scan")
+		}
+
+		if !fn(pos, payload) {
+			return nil
+		}
+		pos += 8 + int64(length) + 4
+	}
+}
+
+// DeleteSegment removes segmentNumber from disk. It refuses to delete the
+// active segment, since that would leave the log with nowhere to append to.
+func (sl *SegmentedLog) DeleteSegment(segmentNumber uint32) error {
+	if sl.activeSeg != nil && sl.activeSeg.number == segmentNumber {
+		return fmt.Errorf("cannot delete active segment %d", segmentNumber)
+	}
+
+	seg := sl.segmentByNumber(segmentNumber)
+	if seg == nil {
+		return nil
+	}
+
+	sl.closeHandle(segmentNumber)
+	if err := os.Remove(seg.path); err != nil {
+		return err
+	}
+
+	for i, s := range sl.segments {
+		if s.number == segmentNumber {
+			sl.segments = append(sl.segments[:i], sl.segments[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Size returns the offset the next Append will write at, encoded the same
+// way as every other offset returned by this log.
+func (sl *SegmentedLog) Size() (offset uint64, err error) {
+	return encodeOffset(sl.activeSeg.number, sl.activeSeg.size), nil
+}
+
+// Sync forces any buffered writes to the active segment to disk. It lets
+// callers that batch up several Appends (see WriteAheadLog.Write) issue a
+// single fsync after all of them.
+func (sl *SegmentedLog) Sync() error {
+	return sl.active.Sync()
+}
+
+// Close closes the active segment and every open read handle.
+func (sl *SegmentedLog) Close() error {
+	for _, h := range sl.handles {
+		h.file.Close()
+	}
+	sl.handles = nil
+
+	if sl.active != nil {
+		err := sl.active.Close()
+		sl.active = nil
+		return err
+	}
+	return nil
+}
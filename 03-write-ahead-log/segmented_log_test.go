@@ -0,0 +1,147 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func CreateSegmentedLog(t *testing.T, segmentSize int64) (*SegmentedLog, func()) {
+	dir, err := os.MkdirTemp("", "segmented-log")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %v", err)
+	}
+
+	log, err := NewSegmentedLogSize(dir, segmentSize)
+	if err != nil {
+		t.Fatalf("cannot create segmented log: %v", err)
+	}
+
+	cleanup := func() {
+		if err := log.Close(); err != nil {
+			t.Errorf("cannot close log: %v", err)
+		}
+		os.RemoveAll(dir)
+	}
+
+	return log, cleanup
+}
+
+func TestSegmentedLogAppendAndRead(t *testing.T) {
+	t.Parallel()
+	log, cleanup := CreateSegmentedLog(t, DefaultSegmentSize)
+	defer cleanup()
+
+	record := []byte("hello, world")
+	offset, err := log.Append(record)
+	if err != nil {
+		t.Fatalf("cannot append record: %v", err)
+	}
+
+	got, _, err := log.Read(offset)
+	if err != nil {
+		t.Fatalf("cannot read record: %v", err)
+	}
+	if !bytes.Equal(got, record) {
+		t.Errorf("got %q, want %q", got, record)
+	}
+}
+
+func TestSegmentedLogRotatesAcrossSegments(t *testing.T) {
+	t.Parallel()
+	// Use a tiny segment size so a handful of records forces rotation.
+	log, cleanup := CreateSegmentedLog(t, 64)
+	defer cleanup()
+
+	records := [][]byte{
+		[]byte("first record"),
+		[]byte("second record"),
+		[]byte("third record"),
+		[]byte("fourth record"),
+	}
+
+	offsets := make([]uint64, len(records))
+	for i, record := range records {
+		var err error
+		offsets[i], err = log.Append(record)
+		if err != nil {
+			t.Fatalf("cannot append record %d: %v", i, err)
+		}
+	}
+
+	if len(log.segments) < 2 {
+		t.Fatalf("expected rotation to produce multiple segments, got %d", len(log.segments))
+	}
+
+	for i, offset := range offsets {
+		got, _, err := log.Read(offset)
+		if err != nil {
+			t.Fatalf("cannot read record %d: %v", i, err)
+		}
+		if !bytes.Equal(got, records[i]) {
+			t.Errorf("record %d: got %q, want %q", i, got, records[i])
+		}
+	}
+}
+
+func TestSegmentedLogReopenReplaysSegments(t *testing.T) {
+	t.Parallel()
+	dir, err := os.MkdirTemp("", "segmented-log")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, err := NewSegmentedLogSize(dir, 64)
+	if err != nil {
+		t.Fatalf("cannot create segmented log: %v", err)
+	}
+
+	records := [][]byte{
+		[]byte("first record"),
+		[]byte("second record"),
+		[]byte("third record"),
+	}
+	for _, record := range records {
+		if _, err := log.Append(record); err != nil {
+			t.Fatalf("cannot append record: %v", err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatalf("cannot close log: %v", err)
+	}
+
+	reopened, err := NewSegmentedLogSize(dir, 64)
+	if err != nil {
+		t.Fatalf("cannot reopen segmented log: %v", err)
+	}
+	defer reopened.Close()
+
+	if len(reopened.segments) != len(log.segments) {
+		t.Fatalf("got %d segments after reopen, want %d", len(reopened.segments), len(log.segments))
+	}
+}
+
+func TestSegmentedLogRetainLast(t *testing.T) {
+	t.Parallel()
+	log, cleanup := CreateSegmentedLog(t, 64)
+	defer cleanup()
+
+	for i := 0; i < 6; i++ {
+		if _, err := log.Append([]byte("record to force rotation")); err != nil {
+			t.Fatalf("cannot append record %d: %v", i, err)
+		}
+	}
+
+	before := len(log.segments)
+	if before < 3 {
+		t.Fatalf("expected at least 3 segments before RetainLast, got %d", before)
+	}
+
+	if err := log.RetainLast(2); err != nil {
+		t.Fatalf("cannot retain last segments: %v", err)
+	}
+	if len(log.segments) != 2 {
+		t.Errorf("got %d segments after RetainLast(2), want 2", len(log.segments))
+	}
+}
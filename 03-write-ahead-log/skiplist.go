@@ -0,0 +1,289 @@
+package log
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+)
+
+// Comparator orders two keys the way a Go comparison function would: a
+// negative result means a < b, zero means a == b, and positive means a > b.
+type Comparator func(a, b []byte) int
+
+// ByteComparator is the default Comparator, ordering keys the same way
+// bytes.Compare does.
+func ByteComparator(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+// skiplistMaxLevel bounds how many forward pointers a node can have. 16
+// levels comfortably supports the millions-of-entries range this WAL demo
+// is meant to illustrate, in the style of Badger's memTable.sl.
+const skiplistMaxLevel = 16
+
+// skiplistP is the probability a node is promoted to the next level.
+const skiplistP = 0.25
+
+// skiplistNode is one entry of the skiplist: a key, its value, and a
+// forward pointer for each level the node participates in.
+type skiplistNode struct {
+	key     []byte
+	value   []byte
+	forward []*skiplistNode
+}
+
+// Skiplist is a sorted, concurrency-safe in-memory index keyed by []byte
+// with a pluggable Comparator, used by WriteAheadLog in place of a plain
+// unordered map so that range scans and ordered iteration are possible.
+type Skiplist struct {
+	mu    sync.RWMutex
+	head  *skiplistNode
+	level int
+	cmp   Comparator
+}
+
+// NewSkiplist creates an empty Skiplist ordered by cmp. A nil cmp defaults
+// to ByteComparator.
+func NewSkiplist(cmp Comparator) *Skiplist {
+	if cmp == nil {
+		cmp = ByteComparator
+	}
+	return &Skiplist{
+		head:  &skiplistNode{forward: make([]*skiplistNode, skiplistMaxLevel)},
+		level: 1,
+		cmp:   cmp,
+	}
+}
+
+// randomLevel picks how many levels a newly-inserted node should span.
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// search walks the skiplist from the top level down, returning the node
+// search ends on at each level (update) so Put/Delete can splice in or
+// unlink a node without a second pass.
+func (sl *Skiplist) search(key []byte) (update [skiplistMaxLevel]*skiplistNode, found *skiplistNode) {
+	node := sl.head
+	for level := sl.level - 1; level >= 0; level-- {
+		for node.forward[level] != nil && sl.cmp(node.forward[level].key, key) < 0 {
+			node = node.forward[level]
+		}
+		update[level] = node
+	}
+
+	if next := node.forward[0]; next != nil && sl.cmp(next.key, key) == 0 {
+		found = next
+	}
+	return update, found
+}
+
+// Put inserts key/value, overwriting any existing value for key.
+func (sl *Skiplist) Put(key, value []byte) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	update, found := sl.search(key)
+	if found != nil {
+		found.value = value
+		return
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for l := sl.level; l < level; l++ {
+			update[l] = sl.head
+		}
+		sl.level = level
+	}
+
+	node := &skiplistNode{key: key, value: value, forward: make([]*skiplistNode, level)}
+	for l := 0; l < level; l++ {
+		node.forward[l] = update[l].forward[l]
+		update[l].forward[l] = node
+	}
+}
+
+// Get returns the value for key and whether it was present.
+func (sl *Skiplist) Get(key []byte) (value []byte, ok bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	_, found := sl.search(key)
+	if found == nil {
+		return nil, false
+	}
+	return found.value, true
+}
+
+// Delete removes key, if present.
+func (sl *Skiplist) Delete(key []byte) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	update, found := sl.search(key)
+	if found == nil {
+		return
+	}
+
+	for l := 0; l < sl.level; l++ {
+		if update[l].forward[l] != found {
+			continue
+		}
+		update[l].forward[l] = found.forward[l]
+	}
+
+	for sl.level > 1 && sl.head.forward[sl.level-1] == nil {
+		sl.level--
+	}
+}
+
+// ForEach calls fn with every key/value in ascending order, stopping early
+// if fn returns false.
+func (sl *Skiplist) ForEach(fn func(key, value []byte) bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	for node := sl.head.forward[0]; node != nil; node = node.forward[0] {
+		if !fn(node.key, node.value) {
+			return
+		}
+	}
+}
+
+// IteratorOptions configures a Skiplist/WriteAheadLog iterator.
+type IteratorOptions struct {
+	// Reverse iterates from the largest key to the smallest. Skiplists are
+	// singly-linked forward, so a reverse iterator buffers matching keys
+	// up front rather than walking backward node-by-node.
+	Reverse bool
+}
+
+// Iterator walks an ordered key space.
+type Iterator interface {
+	// Seek positions the iterator at the first key >= seek key (or, in
+	// reverse mode, the first key <= seek key). Passing nil seeks to the
+	// first (or, in reverse mode, last) key.
+	Seek(key []byte)
+	// Next advances the iterator.
+	Next()
+	// Valid reports whether the iterator is positioned on an entry.
+	Valid() bool
+	// Key returns the current entry's key. Only valid when Valid() is true.
+	Key() []byte
+	// Value returns the current entry's value. Only valid when Valid() is true.
+	Value() []byte
+}
+
+// skiplistIterator is the forward-only Iterator backing NewIterator with
+// IteratorOptions.Reverse == false.
+type skiplistIterator struct {
+	sl  *Skiplist
+	cur *skiplistNode
+}
+
+func (it *skiplistIterator) Seek(key []byte) {
+	it.sl.mu.RLock()
+	defer it.sl.mu.RUnlock()
+
+	if key == nil {
+		it.cur = it.sl.head.forward[0]
+		return
+	}
+
+	update, found := it.sl.search(key)
+	if found != nil {
+		it.cur = found
+		return
+	}
+	it.cur = update[0].forward[0]
+}
+
+func (it *skiplistIterator) Next() {
+	if it.cur == nil {
+		return
+	}
+	it.sl.mu.RLock()
+	defer it.sl.mu.RUnlock()
+	it.cur = it.cur.forward[0]
+}
+
+func (it *skiplistIterator) Valid() bool   { return it.cur != nil }
+func (it *skiplistIterator) Key() []byte   { return it.cur.key }
+func (it *skiplistIterator) Value() []byte { return it.cur.value }
+
+// reverseIterator walks a pre-collected, descending slice of entries. It
+// backs NewIterator with IteratorOptions.Reverse == true.
+type reverseIterator struct {
+	entries []skiplistEntry
+	pos     int
+	cmp     Comparator
+}
+
+type skiplistEntry struct {
+	key, value []byte
+}
+
+func newReverseIterator(sl *Skiplist) *reverseIterator {
+	var entries []skiplistEntry
+	sl.ForEach(func(key, value []byte) bool {
+		entries = append(entries, skiplistEntry{key, value})
+		return true
+	})
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return &reverseIterator{entries: entries, pos: -1, cmp: sl.cmp}
+}
+
+func (it *reverseIterator) Seek(key []byte) {
+	if key == nil {
+		it.pos = 0
+		return
+	}
+	for i, e := range it.entries {
+		if it.cmp(e.key, key) <= 0 {
+			it.pos = i
+			return
+		}
+	}
+	it.pos = len(it.entries)
+}
+
+func (it *reverseIterator) Next() {
+	if it.pos < len(it.entries) {
+		it.pos++
+	}
+}
+
+func (it *reverseIterator) Valid() bool { return it.pos >= 0 && it.pos < len(it.entries) }
+func (it *reverseIterator) Key() []byte { return it.entries[it.pos].key }
+func (it *reverseIterator) Value() []byte { return it.entries[it.pos].value }
+
+// NewIterator returns an Iterator over sl honoring opts.
+func (sl *Skiplist) NewIterator(opts IteratorOptions) Iterator {
+	if opts.Reverse {
+		return newReverseIterator(sl)
+	}
+	return &skiplistIterator{sl: sl}
+}
+
+// Scan calls fn with every key/value pair in [start, end) in ascending
+// order, stopping early if fn returns false. A nil end means "no upper
+// bound".
+func (sl *Skiplist) Scan(start, end []byte, fn func(key, value []byte) bool) {
+	it := sl.NewIterator(IteratorOptions{})
+	it.Seek(start)
+	for ; it.Valid(); it.Next() {
+		if end != nil && sl.cmp(it.Key(), end) >= 0 {
+			return
+		}
+		if !fn(it.Key(), it.Value()) {
+			return
+		}
+	}
+}
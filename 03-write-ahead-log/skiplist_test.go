@@ -0,0 +1,162 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSkiplistPutAndGet(t *testing.T) {
+	t.Parallel()
+	sl := NewSkiplist(nil)
+
+	sl.Put([]byte("b"), []byte("2"))
+	sl.Put([]byte("a"), []byte("1"))
+	sl.Put([]byte("c"), []byte("3"))
+
+	for _, kv := range []struct{ key, value string }{
+		{"a", "1"}, {"b", "2"}, {"c", "3"},
+	} {
+		got, ok := sl.Get([]byte(kv.key))
+		if !ok {
+			t.Fatalf("expected key %q to be present", kv.key)
+		}
+		if string(got) != kv.value {
+			t.Errorf("got %q, want %q", got, kv.value)
+		}
+	}
+}
+
+func TestSkiplistPutOverwritesExistingValue(t *testing.T) {
+	t.Parallel()
+	sl := NewSkiplist(nil)
+
+	sl.Put([]byte("a"), []byte("1"))
+	sl.Put([]byte("a"), []byte("2"))
+
+	got, ok := sl.Get([]byte("a"))
+	if !ok || string(got) != "2" {
+		t.Errorf("got %q, ok=%v, want %q", got, ok, "2")
+	}
+}
+
+func TestSkiplistDelete(t *testing.T) {
+	t.Parallel()
+	sl := NewSkiplist(nil)
+
+	sl.Put([]byte("a"), []byte("1"))
+	sl.Delete([]byte("a"))
+
+	if _, ok := sl.Get([]byte("a")); ok {
+		t.Errorf("expected key to be deleted")
+	}
+}
+
+func TestSkiplistForEachIsSorted(t *testing.T) {
+	t.Parallel()
+	sl := NewSkiplist(nil)
+
+	for _, key := range []string{"delta", "alpha", "charlie", "bravo"} {
+		sl.Put([]byte(key), []byte(key))
+	}
+
+	var got []string
+	sl.ForEach(func(key, value []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+
+	want := []string{"alpha", "bravo", "charlie", "delta"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("position %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSkiplistIteratorSeekAndNext(t *testing.T) {
+	t.Parallel()
+	sl := NewSkiplist(nil)
+	for _, key := range []string{"a", "c", "e", "g"} {
+		sl.Put([]byte(key), []byte(key))
+	}
+
+	it := sl.NewIterator(IteratorOptions{})
+	it.Seek([]byte("c"))
+	if !it.Valid() || string(it.Key()) != "c" {
+		t.Fatalf("expected Seek(c) to land on c, got valid=%v key=%q", it.Valid(), it.Key())
+	}
+
+	it.Next()
+	if !it.Valid() || string(it.Key()) != "e" {
+		t.Errorf("expected next key e, got %q", it.Key())
+	}
+
+	// Seeking a key that doesn't exist should land on the next key after it.
+	it.Seek([]byte("d"))
+	if !it.Valid() || string(it.Key()) != "e" {
+		t.Errorf("expected Seek(d) to land on e, got %q", it.Key())
+	}
+}
+
+func TestSkiplistReverseIterator(t *testing.T) {
+	t.Parallel()
+	sl := NewSkiplist(nil)
+	for _, key := range []string{"a", "b", "c"} {
+		sl.Put([]byte(key), []byte(key))
+	}
+
+	it := sl.NewIterator(IteratorOptions{Reverse: true})
+	it.Seek(nil)
+
+	var got []string
+	for ; it.Valid(); it.Next() {
+		got = append(got, string(it.Key()))
+	}
+
+	want := []string{"c", "b", "a"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("position %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSkiplistScanRespectsBounds(t *testing.T) {
+	t.Parallel()
+	sl := NewSkiplist(nil)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		sl.Put([]byte(key), []byte(key))
+	}
+
+	var got []string
+	sl.Scan([]byte("b"), []byte("d"), func(key, value []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+
+	want := []string{"b", "c"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("position %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestByteComparator(t *testing.T) {
+	t.Parallel()
+	if ByteComparator([]byte("a"), []byte("b")) >= 0 {
+		t.Errorf("expected a < b")
+	}
+	if !bytes.Equal([]byte("a"), []byte("a")) {
+		t.Errorf("sanity check failed")
+	}
+}
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// DefaultValueThreshold is the value size, in bytes, above which
+// WriteAheadLog stores a value in its ValueLog instead of inline in the
+// main log, mirroring Badger's WiscKey-style key-value separation.
+const DefaultValueThreshold = 1024
+
+// valuePointerSize is the encoded size of a ValuePointer: a uint32
+// SegmentID, a uint64 Offset, and a uint32 Length.
+const valuePointerSize = 4 + 8 + 4
+
+// ValuePointer locates a value stored in a ValueLog rather than inline in
+// the main log.
+type ValuePointer struct {
+	SegmentID uint32
+	Offset    uint64
+	Length    uint32
+}
+
+func encodeValuePointer(ptr ValuePointer) []byte {
+	buf := make([]byte, valuePointerSize)
+	binary.BigEndian.PutUint32(buf[0:4], ptr.SegmentID)
+	binary.BigEndian.PutUint64(buf[4:12], ptr.Offset)
+	binary.BigEndian.PutUint32(buf[12:16], ptr.Length)
+	return buf
+}
+
+func decodeValuePointer(buf []byte) (ValuePointer, error) {
+	if len(buf) != valuePointerSize {
+		return ValuePointer{}, errors.New("log: malformed value pointer")
+	}
+	return ValuePointer{
+		SegmentID: binary.BigEndian.Uint32(buf[0:4]),
+		Offset:    binary.BigEndian.Uint64(buf[4:12]),
+		Length:    binary.BigEndian.Uint32(buf[12:16]),
+	}, nil
+}
+
+// ValueLog is a directory of append-only segments holding large values that
+// have been moved out of the main log, in the style of WiscKey/Badger. It
+// is built on top of a SegmentedLog: a ValuePointer's SegmentID and Offset
+// are exactly the segment number and local offset a SegmentedLog encodes
+// into its own 64-bit offsets.
+type ValueLog struct {
+	log *SegmentedLog
+}
+
+// NewValueLog opens (or creates) a ValueLog rooted at dir.
+func NewValueLog(dir string) (*ValueLog, error) {
+	sl, err := NewSegmentedLog(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &ValueLog{log: sl}, nil
+}
+
+// Append writes value to the log and returns a pointer to it.
+func (vl *ValueLog) Append(value []byte) (ValuePointer, error) {
+	offset, err := vl.log.Append(value)
+	if err != nil {
+		return ValuePointer{}, err
+	}
+	segmentID, localOffset := decodeOffset(offset)
+	return ValuePointer{SegmentID: segmentID, Offset: uint64(localOffset), Length: uint32(len(value))}, nil
+}
+
+// Get dereferences ptr, reading the value it points to.
+func (vl *ValueLog) Get(ptr ValuePointer) ([]byte, error) {
+	value, _, err := vl.log.Read(encodeOffset(ptr.SegmentID, int64(ptr.Offset)))
+	return value, err
+}
+
+// GC scans segmentID end to end. Every record isLive reports true for is
+// appended to the value log's active segment (GC rotates first if segmentID
+// is itself the active segment) before the old segment is deleted, and
+// its old-to-new ValuePointer mapping is returned so callers can repoint
+// anything that was referencing it.
+//
+// Callers should only GC a value-log segment once every WAL record that
+// could reference it is covered by a WriteAheadLog snapshot (see
+// WriteAheadLog.Compact): otherwise a crash before the next snapshot could
+// replay a stale ValuePointer into a segment GC has already deleted.
+func (vl *ValueLog) GC(segmentID uint32, isLive func(ValuePointer) bool) (map[ValuePointer]ValuePointer, error) {
+	// Relocated records must land outside segmentID, or it can never be
+	// deleted; rotate first if it's still the active segment.
+	if active, err := vl.log.Size(); err == nil {
+		activeSegmentID, _ := decodeOffset(active)
+		if activeSegmentID == segmentID {
+			if err := vl.log.Rotate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	relocations := make(map[ValuePointer]ValuePointer)
+
+	var relocateErr error
+	err := vl.log.ReadSegment(segmentID, func(localOffset int64, record []byte) bool {
+		ptr := ValuePointer{SegmentID: segmentID, Offset: uint64(localOffset), Length: uint32(len(record))}
+		if !isLive(ptr) {
+			return true
+		}
+
+		newOffset, err := vl.log.Append(record)
+		if err != nil {
+			relocateErr = err
+			return false
+		}
+		newSegmentID, newLocalOffset := decodeOffset(newOffset)
+		relocations[ptr] = ValuePointer{SegmentID: newSegmentID, Offset: uint64(newLocalOffset), Length: ptr.Length}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if relocateErr != nil {
+		// A record failed to relocate: it has not been rewritten, so
+		// segmentID must not be deleted out from under it, or that live
+		// value is lost for good.
+		return nil, relocateErr
+	}
+
+	if err := vl.log.DeleteSegment(segmentID); err != nil {
+		return nil, err
+	}
+
+	return relocations, nil
+}
+
+// Sync forces any buffered writes to the value log to disk. WriteAheadLog's
+// commitBatch calls this before syncing the main log whenever a batch wrote
+// a value to the vlog, so a ValuePointer is never made durable before the
+// value it points to.
+func (vl *ValueLog) Sync() error {
+	return vl.log.Sync()
+}
+
+// Close closes the underlying SegmentedLog.
+func (vl *ValueLog) Close() error {
+	return vl.log.Close()
+}
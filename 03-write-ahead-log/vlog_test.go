@@ -0,0 +1,87 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestValueLogAppendAndGet(t *testing.T) {
+	t.Parallel()
+	dir, err := os.MkdirTemp("", "vlog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	vl, err := NewValueLog(dir)
+	if err != nil {
+		t.Fatalf("cannot create value log: %v", err)
+	}
+	defer vl.Close()
+
+	value := []byte("a large value that lives in the value log")
+	ptr, err := vl.Append(value)
+	if err != nil {
+		t.Fatalf("cannot append value: %v", err)
+	}
+
+	got, err := vl.Get(ptr)
+	if err != nil {
+		t.Fatalf("cannot get value: %v", err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("got %q, want %q", got, value)
+	}
+}
+
+func TestValueLogGCRewritesLiveRecordsAndDeletesSegment(t *testing.T) {
+	t.Parallel()
+	dir, err := os.MkdirTemp("", "vlog")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	vl, err := NewValueLog(dir)
+	if err != nil {
+		t.Fatalf("cannot create value log: %v", err)
+	}
+	defer vl.Close()
+
+	liveValue := []byte("still referenced")
+	deadValue := []byte("no longer referenced")
+
+	livePtr, err := vl.Append(liveValue)
+	if err != nil {
+		t.Fatalf("cannot append live value: %v", err)
+	}
+	if _, err := vl.Append(deadValue); err != nil {
+		t.Fatalf("cannot append dead value: %v", err)
+	}
+
+	segmentID := livePtr.SegmentID
+	relocations, err := vl.GC(segmentID, func(ptr ValuePointer) bool {
+		return ptr == livePtr
+	})
+	if err != nil {
+		t.Fatalf("cannot GC segment: %v", err)
+	}
+
+	newPtr, ok := relocations[livePtr]
+	if !ok {
+		t.Fatalf("expected live pointer to be relocated")
+	}
+
+	got, err := vl.Get(newPtr)
+	if err != nil {
+		t.Fatalf("cannot read relocated value: %v", err)
+	}
+	if !bytes.Equal(got, liveValue) {
+		t.Errorf("got %q, want %q", got, liveValue)
+	}
+
+	if _, err := os.Stat(dir + "/" + segmentFileName(segmentID)); !os.IsNotExist(err) {
+		t.Errorf("expected old segment %d to be deleted", segmentID)
+	}
+}
@@ -2,20 +2,79 @@ package log
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"hash/crc32"
 	"io"
+	"os"
 )
 
 // WriteAheadLog keeps track of Key-Value pairs in a persistent manner.
 // This means that if the program crashes, the Key-Value pairs will still be available on disk,
 // and will be read back into memory when the program (using the WriteAheadLog) is restarted.
 type WriteAheadLog struct {
-	// The FileLog that the WriteAheadLog will write to.
-	log *FileLog
-	// The Key-Value data that the WriteAheadLog will write to the FileLog.
-	// Note: string is used as the Key type because byte slices cannot be used as keys.
-	//       So, the byte slice Key is converted to a string Key.
-	data map[string][]byte
+	// The Log that the WriteAheadLog will write to.
+	log Log
+	// index is the in-memory, sorted view of the Key-Value data the
+	// WriteAheadLog has written to the Log. It is what makes range scans
+	// and ordered iteration over a WriteAheadLog possible.
+	index *Skiplist
+
+	// policy controls automatic snapshot compaction; see CompactionPolicy.
+	policy CompactionPolicy
+	// writesSinceCompaction counts committed Put/Delete operations (each
+	// one inside a Batch included) since Compact last wrote a snapshot;
+	// Compact resets it once its snapshot has been written.
+	writesSinceCompaction int
+
+	// valueLog, when non-nil, is where values larger than valueThreshold
+	// are stored instead of inline in the main log; see ValueLogOptions.
+	valueLog       *ValueLog
+	valueThreshold int
+
+	// options configures the group-commit pipeline; see WALOptions.
+	options WALOptions
+	// writeCh is where Write enqueues batches for runCommitLoop to pick up.
+	writeCh chan *writeRequest
+	// stopCh is closed by Close to stop runCommitLoop.
+	stopCh chan struct{}
+	// commitLoopDone is closed by runCommitLoop right before it returns, so
+	// Close can wait for any commit already in flight to finish before it
+	// closes the underlying Log out from under it.
+	commitLoopDone chan struct{}
+}
+
+// ValueLogOptions enables WiscKey-style key-value separation: values larger
+// than Threshold are written to a ValueLog directory instead of inline in
+// the main log, keeping the main log (and therefore recovery) fast even
+// when values are large.
+type ValueLogOptions struct {
+	// Dir is the directory the ValueLog's segments live in. Leaving it
+	// empty disables value-log separation entirely.
+	Dir string
+	// Threshold is the value size above which a value is moved to the
+	// ValueLog. Zero means DefaultValueThreshold.
+	Threshold int
+}
+
+// flagValuePointer marks a WriteOperation's Value as a serialized
+// ValuePointer rather than the literal value, mirroring Badger's
+// bitValuePointer.
+const flagValuePointer byte = 1 << 0
+
+// CompactionPolicy controls how and when WriteAheadLog takes a snapshot of
+// its in-memory state and reclaims the log records that snapshot makes
+// redundant.
+type CompactionPolicy struct {
+	// SnapshotPath is where Compact (and any automatic compaction) writes
+	// the snapshot, and where NewWriteAheadLogWithLog looks for one on
+	// startup. Leaving it empty disables snapshotting entirely.
+	SnapshotPath string
+	// CompactEvery is the number of writes between automatic compactions.
+	// Zero (the default) disables automatic compaction; callers can still
+	// invoke Compact explicitly.
+	CompactEvery int
 }
 
 // WriteOperation is a single write operation that is performed to modify the WriteAheadLog.
@@ -23,6 +82,9 @@ type WriteOperation struct {
 	WriteOperationType WriteOperationType
 	Key                []byte
 	Value              []byte
+	// Flags holds bit-flags about Value, such as flagValuePointer. It is
+	// zero for a WriteAheadLog that has no ValueLog configured.
+	Flags byte
 }
 
 // WriteOperationType is the type of write operation that is being performed.
@@ -33,6 +95,15 @@ const (
 	DELETE = 1
 )
 
+// snapshotMagic identifies a snapshot file written by Snapshot.
+const snapshotMagic uint32 = 0x534e4150 // "SNAP"
+
+// snapshotFormatVersion is the 1-byte format version following the magic.
+const snapshotFormatVersion byte = 1
+
+// snapshotHeaderSize is magic(4) + version(1) + wal offset(8) + data length(8).
+const snapshotHeaderSize = 4 + 1 + 8 + 8
+
 func init() {
 	gob.Register(WriteOperation{})
 }
@@ -46,120 +117,422 @@ func NewWriteAheadLog(path string) (*WriteAheadLog, error) {
 	return NewWriteAheadLogWithFileLog(log)
 }
 
+// NewWriteAheadLogWithOptions is like NewWriteAheadLog but also accepts a
+// CompactionPolicy, so callers can enable snapshotting on a plain FileLog.
+func NewWriteAheadLogWithOptions(path string, policy CompactionPolicy) (*WriteAheadLog, error) {
+	log, err := NewFileLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWriteAheadLogWithLog(log, policy)
+}
+
+// NewSegmentedWriteAheadLog is like NewWriteAheadLog but stores its records
+// in a SegmentedLog directory instead of a single file, so that Compact can
+// reclaim disk space by dropping whole segments a snapshot has superseded.
+func NewSegmentedWriteAheadLog(dir string, policy CompactionPolicy) (*WriteAheadLog, error) {
+	log, err := NewSegmentedLog(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWriteAheadLogWithLog(log, policy)
+}
+
 func NewWriteAheadLogWithFileLog(log *FileLog) (*WriteAheadLog, error) {
-	data, err := readAllLogEntries(log)
+	return NewWriteAheadLogWithLog(log, CompactionPolicy{})
+}
+
+// NewWriteAheadLogWithValueLog is like NewWriteAheadLog but also separates
+// large values out into a ValueLog directory; see ValueLogOptions.
+func NewWriteAheadLogWithValueLog(path string, vlogOpts ValueLogOptions, policy CompactionPolicy) (*WriteAheadLog, error) {
+	log, err := NewFileLog(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return &WriteAheadLog{
-		log:  log,
-		data: data,
-	}, nil
+	return newWriteAheadLog(log, vlogOpts, policy, WALOptions{})
 }
 
-func (wal *WriteAheadLog) Get(key []byte) (value []byte, err error) {
-	return wal.data[string(key)], nil
+// NewWriteAheadLogWithLog opens a WriteAheadLog on top of an already-open
+// Log, applying policy. If policy.SnapshotPath names an existing, valid
+// snapshot, it is loaded first and only the log records written after the
+// snapshot's recorded offset are replayed on top of it.
+func NewWriteAheadLogWithLog(log Log, policy CompactionPolicy) (*WriteAheadLog, error) {
+	return newWriteAheadLog(log, ValueLogOptions{}, policy, WALOptions{})
 }
 
-func (wal *WriteAheadLog) Put(key, value []byte) error {
-	// Create a new WriteOperation object.
-	op := WriteOperation{
-		WriteOperationType: PUT,
-		Key:                key,
-		Value:              value,
+// NewWriteAheadLogWithWALOptions is like NewWriteAheadLog but also accepts
+// WALOptions, letting callers tune the group-commit pipeline that Write (and
+// Put/Delete, which are thin wrappers around it) uses.
+func NewWriteAheadLogWithWALOptions(path string, policy CompactionPolicy, walOpts WALOptions) (*WriteAheadLog, error) {
+	log, err := NewFileLog(path)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create a new buffer to encode the WriteOperation object.
-	buf := new(bytes.Buffer)
+	return newWriteAheadLog(log, ValueLogOptions{}, policy, walOpts)
+}
 
-	// Encode the WriteOperation object.
-	err := gob.NewEncoder(buf).Encode(op)
+func newWriteAheadLog(log Log, vlogOpts ValueLogOptions, policy CompactionPolicy, walOpts WALOptions) (*WriteAheadLog, error) {
+	var valueLog *ValueLog
+	threshold := DefaultValueThreshold
+	if vlogOpts.Dir != "" {
+		vl, err := NewValueLog(vlogOpts.Dir)
+		if err != nil {
+			return nil, err
+		}
+		valueLog = vl
+		if vlogOpts.Threshold > 0 {
+			threshold = vlogOpts.Threshold
+		}
+	}
+
+	wal := &WriteAheadLog{
+		log:            log,
+		index:          NewSkiplist(ByteComparator),
+		policy:         policy,
+		valueLog:       valueLog,
+		valueThreshold: threshold,
+		options:        walOpts.withDefaults(),
+		writeCh:        make(chan *writeRequest),
+		stopCh:         make(chan struct{}),
+		commitLoopDone: make(chan struct{}),
+	}
+
+	var startOffset uint64
+	if policy.SnapshotPath != "" {
+		snapshotData, snapshotOffset, err := loadSnapshot(policy.SnapshotPath)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range snapshotData {
+			wal.index.Put([]byte(key), encodeIndexValue(0, value))
+		}
+		startOffset = snapshotOffset
+	}
+
+	if err := readAllLogEntries(log, wal.index, startOffset, wal.options.OnCorrupt); err != nil {
+		return nil, err
+	}
+
+	go wal.runCommitLoop()
+	if wal.options.ScrubInterval > 0 {
+		if scrubber, ok := log.(Scrubber); ok {
+			go wal.runPeriodicScrub(scrubber)
+		}
+	}
+
+	return wal, nil
+}
+
+// encodeIndexValue tags payload with the flags its WriteOperation was
+// written with, so the index can tell a literal value apart from a
+// serialized ValuePointer without a second lookup.
+func encodeIndexValue(flags byte, payload []byte) []byte {
+	tagged := make([]byte, 1+len(payload))
+	tagged[0] = flags
+	copy(tagged[1:], payload)
+	return tagged
+}
+
+func decodeIndexValue(tagged []byte) (flags byte, payload []byte) {
+	return tagged[0], tagged[1:]
+}
+
+func (wal *WriteAheadLog) Get(key []byte) (value []byte, err error) {
+	tagged, ok := wal.index.Get(key)
+	if !ok {
+		return nil, nil
+	}
+
+	flags, payload := decodeIndexValue(tagged)
+	if flags&flagValuePointer == 0 {
+		return payload, nil
+	}
+
+	ptr, err := decodeValuePointer(payload)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if wal.valueLog == nil {
+		return nil, errors.New("log: value pointer present but no value log configured")
+	}
+	return wal.valueLog.Get(ptr)
+}
+
+// CompactValueLog garbage-collects a single value-log segment: every value
+// still referenced by the current index is rewritten into the value log's
+// active segment (never segmentID itself) and the index is repointed at it,
+// then the old segment is deleted. See
+// ValueLog.GC for the safety requirement around when this should run.
+func (wal *WriteAheadLog) CompactValueLog(segmentID uint32) error {
+	if wal.valueLog == nil {
+		return errors.New("log: no value log configured")
 	}
 
-	// Write the encoded WriteOperation object to the FileLog.
-	_, err = wal.log.Append(buf.Bytes())
+	keyForPointer := make(map[ValuePointer][]byte)
+	wal.index.ForEach(func(key, tagged []byte) bool {
+		flags, payload := decodeIndexValue(tagged)
+		if flags&flagValuePointer == 0 {
+			return true
+		}
+		if ptr, err := decodeValuePointer(payload); err == nil {
+			keyForPointer[ptr] = append([]byte(nil), key...)
+		}
+		return true
+	})
+
+	relocations, err := wal.valueLog.GC(segmentID, func(ptr ValuePointer) bool {
+		_, live := keyForPointer[ptr]
+		return live
+	})
 	if err != nil {
 		return err
 	}
 
-	// Add the Key-Value pair to the map.
-	wal.data[string(key)] = value
+	for oldPtr, newPtr := range relocations {
+		key, ok := keyForPointer[oldPtr]
+		if !ok {
+			continue
+		}
+		wal.index.Put(key, encodeIndexValue(flagValuePointer, encodeValuePointer(newPtr)))
+	}
+
 	return nil
 }
 
+// NewIterator returns an Iterator over the WriteAheadLog's current
+// in-memory index, honoring opts. Its Value returns an entry in the form the
+// index stores it: a one-byte flags prefix followed by either the value
+// itself or an encoded ValuePointer. Unlike Get and Scan, it neither strips
+// that prefix nor reads values back from the ValueLog.
+func (wal *WriteAheadLog) NewIterator(opts IteratorOptions) Iterator {
+	return wal.index.NewIterator(opts)
+}
+
+// Scan calls fn with every key/value pair in [start, end) in ascending
+// order, stopping early if fn returns false. A nil end means "no upper
+// bound". Values kept in the ValueLog are read back from it, as Get does;
+// if one of them cannot be read, Scan stops there.
+func (wal *WriteAheadLog) Scan(start, end []byte, fn func(key, value []byte) bool) {
+	wal.index.Scan(start, end, func(key, tagged []byte) bool {
+		flags, value := decodeIndexValue(tagged)
+		if flags&flagValuePointer != 0 {
+			ptr, err := decodeValuePointer(value)
+			if err != nil || wal.valueLog == nil {
+				return false
+			}
+			if value, err = wal.valueLog.Get(ptr); err != nil {
+				return false
+			}
+		}
+		return fn(key, value)
+	})
+}
+
+// Put is a convenience wrapper around Write for the common case of a single
+// key-value pair: it stages one PUT in a Batch and commits it through the
+// same group-commit pipeline as Write, so concurrent Puts share a single
+// Append and (if WALOptions.SyncWrites is set) a single fsync.
+func (wal *WriteAheadLog) Put(key, value []byte) error {
+	b := new(Batch)
+	b.Put(key, value)
+	return wal.Write(b, false)
+}
+
+// Delete is a convenience wrapper around Write for a single DELETE; see Put.
 func (wal *WriteAheadLog) Delete(key []byte) error {
-	// Create a new WriteOperation object.
-	op := WriteOperation{
-		WriteOperationType: DELETE,
-		Key:                key,
+	b := new(Batch)
+	b.Delete(key)
+	return wal.Write(b, false)
+}
+
+// Snapshot serializes the current in-memory state into a dense record at
+// path: a magic/version header, the WAL offset the snapshot was taken at,
+// the gob-encoded key-value map, and a trailing CRC32 over that encoding.
+// On reopen, NewWriteAheadLogWithLog loads this snapshot and only replays
+// log records written after the recorded offset.
+func (wal *WriteAheadLog) Snapshot(path string) error {
+	offset, err := wal.log.Size()
+	if err != nil {
+		return err
+	}
+
+	// Snapshots are stored as a plain map: the skiplist's ordering is an
+	// in-memory concern and doesn't need to survive a round trip to disk.
+	data := make(map[string][]byte)
+	var forEachErr error
+	wal.index.ForEach(func(key, _ []byte) bool {
+		value, err := wal.Get(key)
+		if err != nil {
+			forEachErr = err
+			return false
+		}
+		data[string(key)] = value
+		return true
+	})
+	if forEachErr != nil {
+		return forEachErr
 	}
 
-	// Create a new buffer to encode the WriteOperation object.
 	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(data); err != nil {
+		return err
+	}
+	encoded := buf.Bytes()
 
-	// Encode the WriteOperation object.
-	err := gob.NewEncoder(buf).Encode(op)
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
 	if err != nil {
 		return err
 	}
+	defer out.Close()
 
-	// Write the encoded WriteOperation object to the FileLog.
-	_, err = wal.log.Append(buf.Bytes())
-	if err != nil {
+	header := make([]byte, snapshotHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], snapshotMagic)
+	header[4] = snapshotFormatVersion
+	binary.BigEndian.PutUint64(header[5:13], offset)
+	binary.BigEndian.PutUint64(header[13:21], uint64(len(encoded)))
+
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	if _, err := out.Write(encoded); err != nil {
+		return err
+	}
+	if err := binary.Write(out, binary.BigEndian, crc32.ChecksumIEEE(encoded)); err != nil {
 		return err
 	}
 
-	// Remove the Key from the map.
-	delete(wal.data, string(key))
 	return nil
 }
 
-func readAllLogEntries(log *FileLog) (data map[string][]byte, err error) {
-	// Initialize an empty map to store the Key-Value pairs.
+// Compact writes a snapshot to policy.SnapshotPath and then, if the
+// underlying log supports it (see Retainer), drops every segment the
+// snapshot makes redundant for replay.
+func (wal *WriteAheadLog) Compact() error {
+	if wal.policy.SnapshotPath == "" {
+		return errors.New("log: cannot compact without a CompactionPolicy.SnapshotPath")
+	}
+
+	if err := wal.Snapshot(wal.policy.SnapshotPath); err != nil {
+		return err
+	}
+	wal.writesSinceCompaction = 0
+
+	if retainer, ok := wal.log.(Retainer); ok {
+		return retainer.RetainLast(1)
+	}
+	return nil
+}
+
+// loadSnapshot reads the snapshot at path, returning (nil, 0, nil) if no
+// snapshot exists there yet.
+func loadSnapshot(path string) (data map[string][]byte, offset uint64, err error) {
+	in, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer in.Close()
+
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, 0, err
+	}
+
+	magic := binary.BigEndian.Uint32(header[0:4])
+	if magic != snapshotMagic {
+		return nil, 0, errors.New("log: bad snapshot magic")
+	}
+	if header[4] != snapshotFormatVersion {
+		return nil, 0, errors.New("log: unsupported snapshot format version")
+	}
+	offset = binary.BigEndian.Uint64(header[5:13])
+	length := binary.BigEndian.Uint64(header[13:21])
+
+	encoded := make([]byte, length)
+	if _, err := io.ReadFull(in, encoded); err != nil {
+		return nil, 0, err
+	}
+
+	var checksum uint32
+	if err := binary.Read(in, binary.BigEndian, &checksum); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(encoded) != checksum {
+		return nil, 0, errors.New("log: corrupt snapshot")
+	}
+
 	data = make(map[string][]byte)
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&data); err != nil {
+		return nil, 0, err
+	}
+
+	return data, offset, nil
+}
 
-	// Start reading from the beginning of the FileLog (offset 0).
-	var offset uint64 = 0
+// readAllLogEntries replays every record starting at startOffset, applying
+// each to index (which may already hold state loaded from a snapshot).
+// onCorrupt controls what happens when Read reports a record as corrupt
+// (see ErrCorrupt): OnCorruptAbort fails replay, OnCorruptSkip drops just
+// that record and keeps going, and OnCorruptTruncate stops replay there as
+// if it were the end of the log.
+func readAllLogEntries(log Log, index *Skiplist, startOffset uint64, onCorrupt OnCorruptPolicy) error {
+	offset := startOffset
 
 	for {
-		// Read the next record from the FileLog.
+		// Read the next record from the Log.
 		record, nextOffset, err := log.Read(offset)
 		if err != nil {
 			if err == io.EOF {
-				// If we've reached the end of the FileLog, break the loop.
+				// If we've reached the end of the Log, break the loop.
 				break
-			} else {
-				// If there was an error reading from the FileLog, return the error.
-				return nil, err
 			}
-		}
 
-		// Create a new Gob decoder.
-		decoder := gob.NewDecoder(bytes.NewBuffer(record))
+			var corrupt *ErrCorrupt
+			if errors.As(err, &corrupt) {
+				switch onCorrupt {
+				case OnCorruptSkip:
+					offset = nextOffset
+					continue
+				case OnCorruptTruncate:
+					return nil
+				}
+			}
 
-		// Decode the record into an WriteOperation object.
-		var op WriteOperation
-		if err := decoder.Decode(&op); err != nil {
-			return nil, err
+			// If there was an error reading from the Log (or onCorrupt is
+			// OnCorruptAbort), return the error.
+			return err
 		}
 
-		// Depending on the WriteOperationType of the WriteOperation, perform the corresponding operation on the map.
-		switch op.WriteOperationType {
-		case PUT:
-			// If WriteOperationType is PUT, add the Key-Value pair to the map.
-			data[string(op.Key)] = op.Value
-		case DELETE:
-			// If WriteOperationType is DELETE, remove the Key from the map.
-			delete(data, string(op.Key))
+		// A record written by the group-commit pipeline (see Write) holds one
+		// or more gob-encoded WriteOperations back to back, so keep decoding
+		// from it until it's exhausted rather than assuming exactly one.
+		decoder := gob.NewDecoder(bytes.NewBuffer(record))
+		for {
+			var op WriteOperation
+			if err := decoder.Decode(&op); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+
+			switch op.WriteOperationType {
+			case PUT:
+				index.Put(op.Key, encodeIndexValue(op.Flags, op.Value))
+			case DELETE:
+				index.Delete(op.Key)
+			}
 		}
 
 		// Move to the next record.
 		offset = nextOffset
 	}
 
-	// Return the map.
-	return data, nil
+	return nil
 }
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"bytes"
 	"os"
 	"testing"
 
@@ -106,6 +107,158 @@ func TestPutAndGetAfterReopen(t *testing.T) {
 	assert.Equal(t, value, gotValue)
 }
 
+func TestSnapshotAndReopenSkipsReplayedEntries(t *testing.T) {
+	t.Parallel()
+	dir, _ := os.MkdirTemp("", "wal")
+	defer os.RemoveAll(dir)
+
+	policy := CompactionPolicy{SnapshotPath: dir + "/snapshot"}
+	wal, err := NewWriteAheadLogWithOptions(dir+"/log", policy)
+	assert.NoError(t, err)
+
+	assert.NoError(t, wal.Put([]byte("Key1"), []byte("Value1")))
+	assert.NoError(t, wal.Put([]byte("Key2"), []byte("Value2")))
+
+	assert.NoError(t, wal.Snapshot(policy.SnapshotPath))
+
+	// Writes after the snapshot must still be replayed on reopen.
+	assert.NoError(t, wal.Put([]byte("Key3"), []byte("Value3")))
+	assert.NoError(t, wal.log.Close())
+
+	reopened, err := NewWriteAheadLogWithOptions(dir+"/log", policy)
+	assert.NoError(t, err)
+	defer reopened.log.Close()
+
+	for _, kv := range []struct{ key, value string }{
+		{"Key1", "Value1"}, {"Key2", "Value2"}, {"Key3", "Value3"},
+	} {
+		got, err := reopened.Get([]byte(kv.key))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(kv.value), got)
+	}
+}
+
+func TestCompactEveryTriggersAutomaticSnapshot(t *testing.T) {
+	t.Parallel()
+	dir, _ := os.MkdirTemp("", "wal")
+	defer os.RemoveAll(dir)
+
+	policy := CompactionPolicy{SnapshotPath: dir + "/snapshot", CompactEvery: 2}
+	wal, err := NewWriteAheadLogWithOptions(dir+"/log", policy)
+	assert.NoError(t, err)
+	defer wal.log.Close()
+
+	assert.NoError(t, wal.Put([]byte("Key1"), []byte("Value1")))
+	if _, err := os.Stat(policy.SnapshotPath); !os.IsNotExist(err) {
+		t.Fatalf("snapshot should not exist before CompactEvery writes have happened")
+	}
+
+	assert.NoError(t, wal.Put([]byte("Key2"), []byte("Value2")))
+	if _, err := os.Stat(policy.SnapshotPath); err != nil {
+		t.Fatalf("expected automatic snapshot after %d writes: %v", policy.CompactEvery, err)
+	}
+}
+
+func TestCompactReclaimsSegmentsOnSegmentedLog(t *testing.T) {
+	t.Parallel()
+	dir, _ := os.MkdirTemp("", "wal")
+	defer os.RemoveAll(dir)
+
+	policy := CompactionPolicy{SnapshotPath: dir + "/snapshot"}
+	wal, err := NewSegmentedWriteAheadLog(dir+"/segments", policy)
+	assert.NoError(t, err)
+	defer wal.log.Close()
+
+	segmentedLog := wal.log.(*SegmentedLog)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, wal.Put([]byte("Key"), []byte("Value")))
+		// Seal each record into a segment of its own, so that there are
+		// segments for Compact to reclaim.
+		assert.NoError(t, segmentedLog.Rotate())
+	}
+
+	before := len(segmentedLog.segments)
+	if before < 2 {
+		t.Fatalf("expected several segments before Compact, got %d", before)
+	}
+
+	assert.NoError(t, wal.Compact())
+
+	if len(segmentedLog.segments) != 1 {
+		t.Errorf("expected Compact to keep only the active segment, got %d from %d", len(segmentedLog.segments), before)
+	}
+}
+
+func TestWriteAheadLogScanIsOrdered(t *testing.T) {
+	t.Parallel()
+	dir, _ := os.MkdirTemp("", "wal")
+	defer os.RemoveAll(dir)
+
+	wal, _ := NewWriteAheadLog(dir + "/log")
+	defer wal.log.Close()
+
+	for _, key := range []string{"charlie", "alpha", "delta", "bravo"} {
+		assert.NoError(t, wal.Put([]byte(key), []byte(key)))
+	}
+
+	var got []string
+	wal.Scan([]byte("alpha"), []byte("delta"), func(key, value []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+
+	assert.Equal(t, []string{"alpha", "bravo", "charlie"}, got)
+}
+
+func TestPutLargeValueGoesToValueLog(t *testing.T) {
+	t.Parallel()
+	dir, _ := os.MkdirTemp("", "wal")
+	defer os.RemoveAll(dir)
+
+	vlogOpts := ValueLogOptions{Dir: dir + "/vlog", Threshold: 16}
+	wal, err := NewWriteAheadLogWithValueLog(dir+"/log", vlogOpts, CompactionPolicy{})
+	assert.NoError(t, err)
+	defer wal.log.Close()
+
+	key := []byte("Key")
+	value := bytes.Repeat([]byte("v"), 64)
+	assert.NoError(t, wal.Put(key, value))
+
+	tagged, ok := wal.index.Get(key)
+	assert.True(t, ok)
+	flags, _ := decodeIndexValue(tagged)
+	if flags&flagValuePointer == 0 {
+		t.Fatalf("expected large value to be stored as a pointer")
+	}
+
+	got, err := wal.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, value, got)
+}
+
+func TestValueLogSurvivesReopen(t *testing.T) {
+	t.Parallel()
+	dir, _ := os.MkdirTemp("", "wal")
+	defer os.RemoveAll(dir)
+
+	vlogOpts := ValueLogOptions{Dir: dir + "/vlog", Threshold: 16}
+	wal, err := NewWriteAheadLogWithValueLog(dir+"/log", vlogOpts, CompactionPolicy{})
+	assert.NoError(t, err)
+
+	key := []byte("Key")
+	value := bytes.Repeat([]byte("v"), 64)
+	assert.NoError(t, wal.Put(key, value))
+	assert.NoError(t, wal.log.Close())
+
+	reopened, err := NewWriteAheadLogWithValueLog(dir+"/log", vlogOpts, CompactionPolicy{})
+	assert.NoError(t, err)
+	defer reopened.log.Close()
+
+	got, err := reopened.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, value, got)
+}
+
 func TestWriteMultipleRecordsAndReopen(t *testing.T) {
 	t.Parallel()
 	dir, _ := os.MkdirTemp("", "wal")